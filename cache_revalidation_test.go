@@ -0,0 +1,363 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Tests in this file cover RFC 7234 conditional revalidation: once a cached
+// response's freshness lifetime has elapsed, the edge should revalidate with
+// origin using If-None-Match/If-Modified-Since rather than blindly treating
+// the object as a cache MISS, and honour the various cache-control
+// directives that influence when revalidation is required.
+
+const revalidationRespTTL = time.Duration(2 * time.Second)
+const revalidationWaitForExpiry = revalidationRespTTL + (1 * time.Second)
+
+// originHandlerAlways304 serves a fresh response with the given ETag and
+// Last-Modified on the first request, then responds 304 Not Modified to
+// every later request, echoing the same validators, except that a request
+// whose If-None-Match is set and differs from etag gets 412 Precondition
+// Failed. If seenINM is non-nil, the If-None-Match value received on each
+// later request is recorded into it.
+func originHandlerAlways304(body, etag, lastModified, cacheControl string, seenINM *string) http.HandlerFunc {
+	requestCount := 0
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+
+		if requestCount > 1 {
+			inm := r.Header.Get("If-None-Match")
+			if seenINM != nil {
+				*seenINM = inm
+			}
+			if inm != "" && inm != etag {
+				http.Error(w, "unexpected If-None-Match", http.StatusPreconditionFailed)
+				return
+			}
+			RecordRevalidation()
+			w.Header().Set("ETag", etag)
+			w.Header().Set("Last-Modified", lastModified)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte(body))
+	}
+}
+
+// originHandlerNewETagOnRevalidation serves a fresh response on the first
+// request, then a changed body and ETag on every subsequent request,
+// regardless of the validators presented.
+func originHandlerNewETagOnRevalidation(firstBody, firstETag, secondBody, secondETag, lastModified, cacheControl string) http.HandlerFunc {
+	requestCount := 0
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Header().Set("Last-Modified", lastModified)
+		if requestCount > 1 {
+			RecordRevalidation()
+			w.Header().Set("ETag", secondETag)
+			w.Write([]byte(secondBody))
+			return
+		}
+		w.Header().Set("ETag", firstETag)
+		w.Write([]byte(firstBody))
+	}
+}
+
+// originHandler500OnRevalidation serves a fresh response on the first
+// request, then a 500 to any revalidation attempt thereafter.
+func originHandler500OnRevalidation(body, etag, lastModified, cacheControl string) http.HandlerFunc {
+	requestCount := 0
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+
+		if requestCount > 1 {
+			RecordRevalidation()
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("revalidation failed"))
+			return
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte(body))
+	}
+}
+
+func bodyString(t *testing.T, resp *http.Response) string {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// Should revalidate with If-None-Match once a cached response has expired,
+// and serve the cached body with a refreshed Age when origin returns 304.
+func TestRevalidationIfNoneMatch(t *testing.T) {
+	defer RecordTestLatency(t.Name(), time.Now())
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "still the freshest prince"
+	const etag = `"abc123"`
+	cacheControl := fmt.Sprintf("max-age=%.0f, must-revalidate", revalidationRespTTL.Seconds())
+
+	seenINM := ""
+	SetBackendHandler(originServer, originHandlerAlways304(
+		expectedBody, etag, "Mon, 01 Jan 2024 00:00:00 GMT", cacheControl, &seenINM,
+	))
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckErrorInstrumented(t, req)
+	if bodyStr := bodyString(t, resp); bodyStr != expectedBody {
+		t.Fatalf("Unexpected body on first request: got %q, want %q", bodyStr, expectedBody)
+	}
+
+	time.Sleep(revalidationWaitForExpiry)
+
+	resp = RoundTripCheckErrorInstrumented(t, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected revalidated response to be 200, got %d", resp.StatusCode)
+	}
+	if bodyStr := bodyString(t, resp); bodyStr != expectedBody {
+		t.Errorf("Revalidated body changed unexpectedly: got %q, want %q", bodyStr, expectedBody)
+	}
+	if age := resp.Header.Get("Age"); age == "0" || age == "" {
+		t.Errorf("Expected a refreshed, non-zero Age header after revalidation, got %q", age)
+	}
+	if seenINM != etag {
+		t.Errorf("Expected If-None-Match to echo %q, got %q", etag, seenINM)
+	}
+}
+
+// Should revalidate with If-Modified-Since once a cached response has
+// expired, echoing the Last-Modified received from origin.
+func TestRevalidationIfModifiedSince(t *testing.T) {
+	defer RecordTestLatency(t.Name(), time.Now())
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "same as it ever was"
+	const lastModified = "Mon, 01 Jan 2024 00:00:00 GMT"
+	cacheControl := fmt.Sprintf("max-age=%.0f, must-revalidate", revalidationRespTTL.Seconds())
+
+	seenIMS := ""
+	requestCount := 0
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if requestCount > 1 {
+			RecordRevalidation()
+			seenIMS = r.Header.Get("If-Modified-Since")
+			w.Header().Set("Last-Modified", lastModified)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+	RoundTripCheckErrorInstrumented(t, req).Body.Close()
+
+	time.Sleep(revalidationWaitForExpiry)
+
+	resp := RoundTripCheckErrorInstrumented(t, req)
+	if bodyStr := bodyString(t, resp); bodyStr != expectedBody {
+		t.Errorf("Unexpected body after revalidation: got %q, want %q", bodyStr, expectedBody)
+	}
+	if seenIMS != lastModified {
+		t.Errorf("Expected If-Modified-Since to echo %q, got %q", lastModified, seenIMS)
+	}
+}
+
+// Should serve a fresh 200 with the new body when origin returns a changed
+// ETag on revalidation, rather than continuing to serve the stale cached
+// object.
+func TestRevalidationETagChangedServesFreshBody(t *testing.T) {
+	defer RecordTestLatency(t.Name(), time.Now())
+	ResetBackends(backendsByPriority)
+
+	const staleBody = "the old guard"
+	const freshBody = "new blood"
+	cacheControl := fmt.Sprintf("max-age=%.0f, must-revalidate", revalidationRespTTL.Seconds())
+
+	SetBackendHandler(originServer, originHandlerNewETagOnRevalidation(
+		staleBody, `"v1"`, freshBody, `"v2"`, "Mon, 01 Jan 2024 00:00:00 GMT", cacheControl,
+	))
+
+	req := NewUniqueEdgeGET(t)
+	RoundTripCheckErrorInstrumented(t, req).Body.Close()
+
+	time.Sleep(revalidationWaitForExpiry)
+
+	resp := RoundTripCheckErrorInstrumented(t, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 for changed ETag, got %d", resp.StatusCode)
+	}
+	if bodyStr := bodyString(t, resp); bodyStr != freshBody {
+		t.Errorf("Expected fresh body %q after ETag change, got %q", freshBody, bodyStr)
+	}
+}
+
+// Should force revalidation at the edge when must-revalidate,
+// proxy-revalidate, or s-maxage are present, even if the edge would
+// otherwise be willing to serve stale.
+func TestRevalidationDirectivesForceRevalidation(t *testing.T) {
+	defer RecordTestLatency(t.Name(), time.Now())
+	directives := []string{
+		"must-revalidate",
+		"proxy-revalidate",
+		fmt.Sprintf("s-maxage=%.0f", revalidationRespTTL.Seconds()),
+	}
+
+	// Pair each forcing directive with a generous stale-while-revalidate
+	// grace. If the directive weren't actually suppressing stale serving,
+	// the grace period alone would be enough for the edge to return the
+	// stale cached body immediately and revalidate in the background - so a
+	// cache that silently ignored must-revalidate/proxy-revalidate/s-maxage
+	// would pass a test that only checked max-age expiry. Asserting that the
+	// second request gets the new body, not the stale one, is what actually
+	// distinguishes "directive honoured" from "directive ignored".
+	for _, directive := range directives {
+		ResetBackends(backendsByPriority)
+
+		const staleBody = "forced to check in"
+		const freshBody = "checked in and refreshed"
+		const staleWhileRevalidate = 10 * revalidationRespTTL
+		cacheControl := fmt.Sprintf(
+			"max-age=%.0f, stale-while-revalidate=%.0f, %s",
+			revalidationRespTTL.Seconds(), staleWhileRevalidate.Seconds(), directive,
+		)
+
+		requestCount := 0
+		SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+			requestCount++
+			w.Header().Set("Cache-Control", cacheControl)
+			if requestCount > 1 {
+				RecordRevalidation()
+				w.Write([]byte(freshBody))
+				return
+			}
+			w.Write([]byte(staleBody))
+		})
+
+		req := NewUniqueEdgeGET(t)
+		RoundTripCheckErrorInstrumented(t, req).Body.Close()
+
+		time.Sleep(revalidationWaitForExpiry)
+		resp := RoundTripCheckErrorInstrumented(t, req)
+
+		if requestCount < 2 {
+			t.Errorf("Directive %q: expected edge to revalidate with origin, saw %d requests", directive, requestCount)
+		}
+		if bodyStr := bodyString(t, resp); bodyStr != freshBody {
+			t.Errorf(
+				"Directive %q: expected edge to serve the revalidated body %q rather than tolerate stale-while-revalidate, got %q",
+				directive, freshBody, bodyStr,
+			)
+		}
+	}
+}
+
+// Should force revalidation on every request when Cache-Control: no-cache
+// is present, even within the freshness lifetime.
+func TestRevalidationNoCacheAlwaysRevalidates(t *testing.T) {
+	defer RecordTestLatency(t.Name(), time.Now())
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "trust but verify"
+	requestCount := 0
+
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		w.Header().Set("Cache-Control", "max-age=3600, no-cache")
+		w.Header().Set("ETag", `"no-cache-etag"`)
+		if requestCount > 1 {
+			RecordRevalidation()
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+	RoundTripCheckErrorInstrumented(t, req).Body.Close()
+	RoundTripCheckErrorInstrumented(t, req).Body.Close()
+
+	if requestCount < 2 {
+		t.Errorf("Expected origin to be revalidated on every request for no-cache, saw %d requests", requestCount)
+	}
+}
+
+// Should not revalidate a response marked immutable, even once its
+// freshness lifetime has elapsed.
+func TestRevalidationImmutableSuppressesRevalidation(t *testing.T) {
+	defer RecordTestLatency(t.Name(), time.Now())
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "set in stone"
+	cacheControl := fmt.Sprintf("max-age=%.0f, immutable", revalidationRespTTL.Seconds())
+	requestCount := 0
+
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if requestCount > 1 {
+			t.Error("Origin received a revalidation request for an immutable response")
+		}
+		w.Header().Set("Cache-Control", cacheControl)
+		w.Header().Set("ETag", `"immutable-etag"`)
+		w.Write([]byte(expectedBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+	RoundTripCheckErrorInstrumented(t, req).Body.Close()
+
+	time.Sleep(revalidationWaitForExpiry)
+	resp := RoundTripCheckErrorInstrumented(t, req)
+
+	if bodyStr := bodyString(t, resp); bodyStr != expectedBody {
+		t.Errorf("Expected immutable body to be served unchanged, got %q", bodyStr)
+	}
+}
+
+// Should serve the stale cached object per RFC 5861 stale-if-error if
+// revalidation fails with a 5xx, rather than surfacing the error to the
+// client.
+func TestRevalidationStaleIfErrorFallback(t *testing.T) {
+	defer RecordTestLatency(t.Name(), time.Now())
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "comfortably stale"
+	cacheControl := fmt.Sprintf(
+		"max-age=%.0f, stale-if-error=%.0f", revalidationRespTTL.Seconds(), revalidationRespTTL.Seconds()*10,
+	)
+
+	SetBackendHandler(originServer, originHandler500OnRevalidation(
+		expectedBody, `"stale-if-error-etag"`, "Mon, 01 Jan 2024 00:00:00 GMT", cacheControl,
+	))
+
+	req := NewUniqueEdgeGET(t)
+	RoundTripCheckErrorInstrumented(t, req).Body.Close()
+
+	time.Sleep(revalidationWaitForExpiry)
+	resp := RoundTripCheckErrorInstrumented(t, req)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected stale-if-error fallback to return 200, got %d", resp.StatusCode)
+	}
+	if bodyStr := bodyString(t, resp); bodyStr != expectedBody {
+		t.Errorf("Expected stale-if-error fallback body %q, got %q", expectedBody, bodyStr)
+	}
+}
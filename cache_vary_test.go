@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// Tests in this file cover Vary-aware cache separation: the edge must keep
+// distinct cache entries per varying request header combination when the
+// origin sets Vary, rather than serving one client's variant to another.
+
+const varyBodyGzip = "squeezed down tight"
+const varyBodyIdentity = "roomy and uncompressed"
+
+// originHandlerVaryAcceptEncoding serves a body keyed on the request's
+// Accept-Encoding header and declares Vary: Accept-Encoding.
+func originHandlerVaryAcceptEncoding() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, public")
+		w.Header().Set("Vary", "Accept-Encoding")
+		if r.Header.Get("Accept-Encoding") == "gzip" {
+			w.Write([]byte(varyBodyGzip))
+		} else {
+			w.Write([]byte(varyBodyIdentity))
+		}
+	}
+}
+
+// Should store distinct cache entries per Accept-Encoding value and serve
+// each client its own variant thereafter, with no cross-contamination.
+func TestCacheVaryAcceptEncoding(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	originHitsByEncoding := map[string]int{}
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		originHitsByEncoding[r.Header.Get("Accept-Encoding")]++
+		originHandlerVaryAcceptEncoding()(w, r)
+	})
+
+	gzipReq := NewUniqueEdgeGET(t)
+	gzipReq.Header.Set("Accept-Encoding", "gzip")
+
+	identityReq, err := http.NewRequest("GET", gzipReq.URL.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityReq.Header.Set("Accept-Encoding", "identity")
+
+	resp := RoundTripCheckErrorInstrumented(t, gzipReq)
+	if bodyStr := bodyString(t, resp); bodyStr != varyBodyGzip {
+		t.Fatalf("Unexpected gzip body on first request: got %q, want %q", bodyStr, varyBodyGzip)
+	}
+
+	resp = RoundTripCheckErrorInstrumented(t, identityReq)
+	if bodyStr := bodyString(t, resp); bodyStr != varyBodyIdentity {
+		t.Fatalf("Unexpected identity body on first request: got %q, want %q", bodyStr, varyBodyIdentity)
+	}
+
+	// Both variants should now be cached - neither request should reach
+	// origin again.
+	resp = RoundTripCheckErrorInstrumented(t, gzipReq)
+	if bodyStr := bodyString(t, resp); bodyStr != varyBodyGzip {
+		t.Errorf("gzip variant leaked cross-contamination: got %q, want %q", bodyStr, varyBodyGzip)
+	}
+	resp = RoundTripCheckErrorInstrumented(t, identityReq)
+	if bodyStr := bodyString(t, resp); bodyStr != varyBodyIdentity {
+		t.Errorf("identity variant leaked cross-contamination: got %q, want %q", bodyStr, varyBodyIdentity)
+	}
+
+	if originHitsByEncoding["gzip"] != 1 {
+		t.Errorf("Expected origin to see exactly 1 gzip request, saw %d", originHitsByEncoding["gzip"])
+	}
+	if originHitsByEncoding["identity"] != 1 {
+		t.Errorf("Expected origin to see exactly 1 identity request, saw %d", originHitsByEncoding["identity"])
+	}
+}
+
+// Should store distinct cache entries per User-Agent when origin varies on
+// it.
+func TestCacheVaryUserAgent(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const uaBot = "bot"
+	const uaBrowser = "browser"
+	bodyByUA := map[string]string{
+		uaBot:     "served to a bot",
+		uaBrowser: "served to a browser",
+	}
+
+	originHits := 0
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		originHits++
+		w.Header().Set("Cache-Control", "max-age=3600, public")
+		w.Header().Set("Vary", "User-Agent")
+		w.Write([]byte(bodyByUA[r.Header.Get("User-Agent")]))
+	})
+
+	botReq := NewUniqueEdgeGET(t)
+	botReq.Header.Set("User-Agent", uaBot)
+
+	browserReq, err := http.NewRequest("GET", botReq.URL.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browserReq.Header.Set("User-Agent", uaBrowser)
+
+	RoundTripCheckErrorInstrumented(t, botReq).Body.Close()
+	RoundTripCheckErrorInstrumented(t, browserReq).Body.Close()
+
+	resp := RoundTripCheckErrorInstrumented(t, botReq)
+	if bodyStr := bodyString(t, resp); bodyStr != bodyByUA[uaBot] {
+		t.Errorf("Expected cached bot variant %q, got %q", bodyByUA[uaBot], bodyStr)
+	}
+	resp = RoundTripCheckErrorInstrumented(t, browserReq)
+	if bodyStr := bodyString(t, resp); bodyStr != bodyByUA[uaBrowser] {
+		t.Errorf("Expected cached browser variant %q, got %q", bodyByUA[uaBrowser], bodyStr)
+	}
+
+	if originHits != 2 {
+		t.Errorf("Expected origin to be hit exactly once per User-Agent variant, saw %d requests", originHits)
+	}
+}
+
+// Should match the varying header name case-insensitively: Go's
+// http.Header.Set canonicalizes the Vary header's own name regardless of how
+// it's set, but the token(s) naming the varying request header inside its
+// value are passed through verbatim, so origin declaring a lower-case
+// "user-agent" token must still be matched against the canonically-cased
+// User-Agent request header.
+func TestCacheVaryHeaderNameCaseInsensitive(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const uaBot = "bot"
+	const uaBrowser = "browser"
+	bodyByUA := map[string]string{
+		uaBot:     "served to a bot",
+		uaBrowser: "served to a browser",
+	}
+
+	originHits := 0
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		originHits++
+		w.Header().Set("Cache-Control", "max-age=3600, public")
+		w.Header().Set("Vary", "user-agent")
+		w.Write([]byte(bodyByUA[r.Header.Get("User-Agent")]))
+	})
+
+	botReq := NewUniqueEdgeGET(t)
+	botReq.Header.Set("User-Agent", uaBot)
+
+	browserReq, err := http.NewRequest("GET", botReq.URL.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	browserReq.Header.Set("User-Agent", uaBrowser)
+
+	RoundTripCheckErrorInstrumented(t, botReq).Body.Close()
+	RoundTripCheckErrorInstrumented(t, browserReq).Body.Close()
+
+	resp := RoundTripCheckErrorInstrumented(t, botReq)
+	if bodyStr := bodyString(t, resp); bodyStr != bodyByUA[uaBot] {
+		t.Errorf("Expected cached bot variant %q, got %q", bodyByUA[uaBot], bodyStr)
+	}
+	resp = RoundTripCheckErrorInstrumented(t, browserReq)
+	if bodyStr := bodyString(t, resp); bodyStr != bodyByUA[uaBrowser] {
+		t.Errorf("Expected cached browser variant %q, got %q", bodyByUA[uaBrowser], bodyStr)
+	}
+
+	if originHits != 2 {
+		t.Errorf("Expected origin to be hit exactly once per User-Agent variant, saw %d requests", originHits)
+	}
+}
+
+// Should separate cache entries correctly when origin varies on more than
+// one header simultaneously.
+func TestCacheVaryMultipleHeaders(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const customHeader = "X-Test-Segment"
+
+	variantKey := func(encoding, segment string) string {
+		return fmt.Sprintf("%s|%s", encoding, segment)
+	}
+	bodyByVariant := map[string]string{
+		variantKey("gzip", "a"):     "gzip segment a",
+		variantKey("gzip", "b"):     "gzip segment b",
+		variantKey("identity", "a"): "identity segment a",
+		variantKey("identity", "b"): "identity segment b",
+	}
+
+	originHits := map[string]int{}
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		key := variantKey(r.Header.Get("Accept-Encoding"), r.Header.Get(customHeader))
+		originHits[key]++
+		w.Header().Set("Cache-Control", "max-age=3600, public")
+		w.Header().Set("Vary", fmt.Sprintf("Accept-Encoding, %s", customHeader))
+		w.Write([]byte(bodyByVariant[key]))
+	})
+
+	base := NewUniqueEdgeGET(t)
+
+	newVariantReq := func(encoding, segment string) *http.Request {
+		req, err := http.NewRequest("GET", base.URL.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept-Encoding", encoding)
+		req.Header.Set(customHeader, segment)
+		return req
+	}
+
+	for _, encoding := range []string{"gzip", "identity"} {
+		for _, segment := range []string{"a", "b"} {
+			req := newVariantReq(encoding, segment)
+			RoundTripCheckErrorInstrumented(t, req).Body.Close()
+		}
+	}
+
+	for _, encoding := range []string{"gzip", "identity"} {
+		for _, segment := range []string{"a", "b"} {
+			key := variantKey(encoding, segment)
+			req := newVariantReq(encoding, segment)
+			resp := RoundTripCheckErrorInstrumented(t, req)
+			if bodyStr := bodyString(t, resp); bodyStr != bodyByVariant[key] {
+				t.Errorf(
+					"Variant %s served wrong body: got %q, want %q",
+					key, bodyStr, bodyByVariant[key],
+				)
+			}
+			if originHits[key] != 1 {
+				t.Errorf("Expected origin to see exactly 1 request for variant %s, saw %d", key, originHits[key])
+			}
+		}
+	}
+}
+
+// Should never cache a response with Vary: *, as it can never be matched
+// against a future request.
+func TestCacheVaryAsteriskNotCached(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	originHits := 0
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		originHits++
+		w.Header().Set("Cache-Control", "max-age=3600, public")
+		w.Header().Set("Vary", "*")
+		w.Write([]byte("never cacheable"))
+	})
+
+	req := NewUniqueEdgeGET(t)
+	RoundTripCheckErrorInstrumented(t, req).Body.Close()
+	RoundTripCheckErrorInstrumented(t, req).Body.Close()
+
+	if originHits < 2 {
+		t.Errorf("Expected Vary: * response never to be served from cache, origin saw %d requests", originHits)
+	}
+}
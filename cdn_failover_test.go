@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sync"
 	"testing"
 	"time"
 )
@@ -14,6 +15,7 @@ import (
 // NB: ideally this should be a page that we control that has a mechanism
 //     to alert us that it has been served.
 func TestFailoverErrorPageAllServersDown(t *testing.T) {
+	defer RecordTestLatency(t.Name(), time.Now())
 
 	originServer.Stop()
 	backupServer1.Stop()
@@ -50,10 +52,123 @@ func TestFailoverErrorPageAllServers5xx(t *testing.T) {
 	t.Error("Not implemented")
 }
 
+// CountRequestsDuring installs handler on server, wrapped to count the
+// requests it serves, waits for d, then returns that count. Nothing is
+// restored afterwards - as throughout this suite, a test that cares what
+// handler is active next must install one explicitly via SetBackendHandler.
+func CountRequestsDuring(server *CDNBackendServer, handler http.HandlerFunc, d time.Duration) int {
+	count := 0
+	var mu sync.Mutex
+
+	SetBackendHandler(server, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		count++
+		mu.Unlock()
+		handler(w, r)
+	})
+
+	time.Sleep(d)
+
+	mu.Lock()
+	defer mu.Unlock()
+	return count
+}
+
 // Should back off requests against origin for a very short period of time
-// if origin returns a 5xx response so as not to overwhelm it.
+// once origin has returned 5xx backOffThreshold times within a window, so
+// as not to overwhelm an origin that's already struggling.
 func TestFailoverOrigin5xxBackOff(t *testing.T) {
-	t.Error("Not implemented")
+	defer RecordTestLatency(t.Name(), time.Now())
+
+	const backOffThreshold = 3
+	const backOffWindow = 2 * time.Second
+	const measureWindow = 1 * time.Second
+	const resumeBuffer = 1 * time.Second
+
+	SetBackendHandler(backupServer1, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(backupServer1.Name))
+	})
+	SetBackendHandler(backupServer2, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(backupServer2.Name))
+	})
+
+	respondServiceUnavailable := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	SetBackendHandler(originServer, respondServiceUnavailable)
+
+	// Drive backOffThreshold 5xx responses through the edge to arm the
+	// back-off window.
+	for i := 0; i < backOffThreshold; i++ {
+		RoundTripCheckErrorInstrumented(t, NewUniqueEdgeGET(t)).Body.Close()
+	}
+
+	// Keep driving traffic through the edge while we measure how many of
+	// those requests actually reach origin during the back-off window. The
+	// goroutine reports transport errors over errCh rather than calling into
+	// testing.T itself - only the goroutine running the test is allowed to
+	// call t.Fatal/t.FailNow. We wait for this goroutine to finish before
+	// the test proceeds, so it can't still be sending on errCh after the
+	// test has moved on.
+	stopClient := make(chan struct{})
+	errCh := make(chan error, 1)
+	var clientWg sync.WaitGroup
+	clientWg.Add(1)
+	go func() {
+		defer clientWg.Done()
+		for {
+			select {
+			case <-stopClient:
+				return
+			default:
+				resp, err := client.RoundTrip(NewUniqueEdgeGET(t))
+				if err != nil {
+					select {
+					case errCh <- err:
+					default:
+					}
+					return
+				}
+				RecordResponse(resp.Header.Get("X-Cache"), resp.StatusCode)
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	duringBackOff := CountRequestsDuring(originServer, respondServiceUnavailable, measureWindow)
+	close(stopClient)
+	clientWg.Wait()
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("Error round tripping request during back-off measurement: %s", err)
+	default:
+	}
+
+	if duringBackOff != 0 {
+		t.Errorf(
+			"Expected origin to be backed off after %d 5xx responses: saw %d requests during back-off window",
+			backOffThreshold, duringBackOff,
+		)
+	}
+
+	// Once the back-off window plus a buffer has elapsed, origin should be
+	// eligible to receive requests again.
+	time.Sleep(backOffWindow - measureWindow + resumeBuffer)
+
+	const expectedBody = "back in rotation"
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(expectedBody))
+	})
+
+	resp := RoundTripCheckErrorInstrumented(t, NewUniqueEdgeGET(t))
+	defer resp.Body.Close()
+	if bodyStr := bodyString(t, resp); bodyStr != expectedBody {
+		t.Errorf(
+			"Expected origin to be back in rotation after back-off window elapsed: got body %q",
+			bodyStr,
+		)
+	}
 }
 
 // Should serve stale object and not hit mirror(s) if origin is down and
@@ -65,6 +180,8 @@ func TestFailoverOriginDownServeStale(t *testing.T) {
 // Should serve stale object and not hit mirror(s) if origin returns a 5xx
 // response and object is beyond TTL but still in cache.
 func TestFailoverOrigin5xxServeStale(t *testing.T) {
+	defer RecordTestLatency(t.Name(), time.Now())
+
 	const expectedResponseStale = "going off like stilton"
 	const expectedResponseFresh = "as fresh as daisies"
 
@@ -74,12 +191,12 @@ func TestFailoverOrigin5xxServeStale(t *testing.T) {
 	const waitSaintMode = time.Duration(5 * time.Second)
 	headerValue := fmt.Sprintf("max-age=%.0f", respTTL.Seconds())
 
-	backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+	SetBackendHandler(backupServer1, func(w http.ResponseWriter, r *http.Request) {
 		name := backupServer1.Name
 		t.Errorf("Server %s received request and it shouldn't have", name)
 		w.Write([]byte(name))
 	})
-	backupServer2.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+	SetBackendHandler(backupServer2, func(w http.ResponseWriter, r *http.Request) {
 		name := backupServer2.Name
 		t.Errorf("Server %s received request and it shouldn't have", name)
 		w.Write([]byte(name))
@@ -93,7 +210,7 @@ func TestFailoverOrigin5xxServeStale(t *testing.T) {
 		case 1: // Request 1 populates cache.
 			expectedBody = expectedResponseStale
 
-			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
 				w.Header().Set("Cache-Control", headerValue)
 				w.Write([]byte(expectedBody))
 			})
@@ -101,7 +218,7 @@ func TestFailoverOrigin5xxServeStale(t *testing.T) {
 			time.Sleep(respTTLWithBuffer)
 			expectedBody = expectedResponseStale
 
-			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(http.StatusServiceUnavailable)
 				w.Write([]byte(originServer.Name))
 			})
@@ -109,12 +226,12 @@ func TestFailoverOrigin5xxServeStale(t *testing.T) {
 			time.Sleep(waitSaintMode)
 			expectedBody = expectedResponseFresh
 
-			originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+			SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
 				w.Write([]byte(expectedBody))
 			})
 		}
 
-		resp := RoundTripCheckError(t, req)
+		resp := RoundTripCheckErrorInstrumented(t, req)
 
 		defer resp.Body.Close()
 		body, err := ioutil.ReadAll(resp.Body)
@@ -141,11 +258,22 @@ func TestFailoverOriginDownUseFirstMirror(t *testing.T) {
 // Should fallback to first mirror if origin returns 5xx response and object
 // is not in cache (active or stale).
 func TestFailoverOrigin5xxUseFirstMirror(t *testing.T) {
+	defer RecordTestLatency(t.Name(), time.Now())
+
 	expectedBody := "lucky golden ticket"
 	expectedStatus := http.StatusOK
 	backendsSawRequest := map[string]bool{}
 
-	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	// Wait for the health checker's probes of origin to mark it unhealthy
+	// before driving the user-facing request below, rather than racing it
+	// against an arbitrary amount of backend-health propagation time.
+	waitUntilBackendsUnhealthy(t, originServer)
+
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
 		name := originServer.Name
 		if !backendsSawRequest[name] {
 			w.WriteHeader(http.StatusServiceUnavailable)
@@ -155,9 +283,10 @@ func TestFailoverOrigin5xxUseFirstMirror(t *testing.T) {
 		}
 		w.Write([]byte(name))
 	})
-	backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+	SetBackendHandler(backupServer1, func(w http.ResponseWriter, r *http.Request) {
 		name := backupServer1.Name
 		if !backendsSawRequest[name] {
+			RecordFailoverEvent(name)
 			w.Write([]byte(expectedBody))
 			backendsSawRequest[name] = true
 		} else {
@@ -165,14 +294,14 @@ func TestFailoverOrigin5xxUseFirstMirror(t *testing.T) {
 			w.Write([]byte(name))
 		}
 	})
-	backupServer2.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+	SetBackendHandler(backupServer2, func(w http.ResponseWriter, r *http.Request) {
 		name := backupServer2.Name
 		t.Errorf("Server %s received a request and it shouldn't have", name)
 		w.Write([]byte(name))
 	})
 
 	req := NewUniqueEdgeGET(t)
-	resp := RoundTripCheckError(t, req)
+	resp := RoundTripCheckErrorInstrumented(t, req)
 
 	if resp.StatusCode != expectedStatus {
 		t.Errorf(
@@ -205,11 +334,26 @@ func TestFailoverOriginDownFirstMirrorDownUseSecondMirror(t *testing.T) {
 // Should fallback to second mirror if both origin and first mirror return
 // 5xx responses.
 func TestFailoverOrigin5xxFirstMirror5xxUseSecondMirror(t *testing.T) {
+	defer RecordTestLatency(t.Name(), time.Now())
+
 	expectedBody := "lucky golden ticket"
 	expectedStatus := http.StatusOK
 	backendsSawRequest := map[string]bool{}
 
-	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	SetBackendHandler(backupServer1, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	// Wait for the health checker's probes of both origin and the first
+	// mirror to mark them unhealthy before driving the user-facing request
+	// below, rather than racing it against an arbitrary amount of
+	// backend-health propagation time.
+	waitUntilBackendsUnhealthy(t, originServer, backupServer1)
+
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
 		name := originServer.Name
 		if !backendsSawRequest[name] {
 			w.WriteHeader(http.StatusServiceUnavailable)
@@ -219,7 +363,7 @@ func TestFailoverOrigin5xxFirstMirror5xxUseSecondMirror(t *testing.T) {
 		}
 		w.Write([]byte(name))
 	})
-	backupServer1.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+	SetBackendHandler(backupServer1, func(w http.ResponseWriter, r *http.Request) {
 		name := backupServer1.Name
 		if !backendsSawRequest[name] {
 			w.WriteHeader(http.StatusServiceUnavailable)
@@ -229,9 +373,10 @@ func TestFailoverOrigin5xxFirstMirror5xxUseSecondMirror(t *testing.T) {
 		}
 		w.Write([]byte(name))
 	})
-	backupServer2.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+	SetBackendHandler(backupServer2, func(w http.ResponseWriter, r *http.Request) {
 		name := backupServer2.Name
 		if !backendsSawRequest[name] {
+			RecordFailoverEvent(name)
 			w.Write([]byte(expectedBody))
 			backendsSawRequest[name] = true
 		} else {
@@ -241,7 +386,7 @@ func TestFailoverOrigin5xxFirstMirror5xxUseSecondMirror(t *testing.T) {
 	})
 
 	req := NewUniqueEdgeGET(t)
-	resp := RoundTripCheckError(t, req)
+	resp := RoundTripCheckErrorInstrumented(t, req)
 
 	if resp.StatusCode != expectedStatus {
 		t.Errorf(
@@ -265,8 +410,138 @@ func TestFailoverOrigin5xxFirstMirror5xxUseSecondMirror(t *testing.T) {
 	}
 }
 
+// Shared HealthChecker parameters for tests that wait for a backend's probed
+// health to flip before driving user-facing traffic, rather than racing
+// an immediate request against backend-health propagation.
+const (
+	failoverProbeInterval      = 200 * time.Millisecond
+	failoverProbeTimeout       = 100 * time.Millisecond
+	failoverUnhealthyThreshold = 2
+	failoverHealthyThreshold   = 2
+	failoverWaitForFlip        = 5 * failoverProbeInterval
+)
+
+// waitUntilBackendsUnhealthy starts a HealthChecker against backends using
+// the shared failover probe parameters, blocks until each is observed
+// unhealthy (failing the test if one isn't within failoverWaitForFlip), and
+// stops the checker before returning so its probe traffic doesn't linger
+// against whatever handler the test installs next.
+func waitUntilBackendsUnhealthy(t *testing.T, backends ...*CDNBackendServer) {
+	hc := NewHealthChecker(
+		"/", http.StatusOK, nil,
+		failoverProbeInterval, failoverProbeTimeout,
+		failoverUnhealthyThreshold, failoverHealthyThreshold,
+	)
+	hc.Start(backends)
+	defer hc.Stop()
+
+	for _, backend := range backends {
+		if err := hc.WaitUntilUnhealthy(backend.Name, failoverWaitForFlip); err != nil {
+			t.Fatalf("Expected health checker to mark %s unhealthy: %s", backend.Name, err)
+		}
+	}
+}
+
+// WithNoFallbackHeader wraps an origin handler so that, in addition to
+// whatever the handler does, it sets the given No-Fallback header on every
+// response. Vendors signal this with different header names, e.g.
+// Fastly-No-Fallback or CDN-No-Fallback.
+func WithNoFallbackHeader(name, value string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(name, value)
+		handler(w, r)
+	}
+}
+
 // Should not fallback to mirror if origin returns a 5xx response with a
 // No-Fallback header.
 func TestFailoverNoFallbackHeader(t *testing.T) {
-	t.Error("Not implemented")
+	defer RecordTestLatency(t.Name(), time.Now())
+
+	var noFallbackHeader string
+	switch {
+	case vendorFastly:
+		noFallbackHeader = "Fastly-No-Fallback"
+	case vendorCloudflare:
+		noFallbackHeader = "CDN-No-Fallback"
+	default:
+		t.Fatal(notImplementedForVendor)
+	}
+
+	SetBackendHandler(backupServer1, func(w http.ResponseWriter, r *http.Request) {
+		name := backupServer1.Name
+		t.Errorf("Server %s received a request and it shouldn't have", name)
+		w.Write([]byte(name))
+	})
+	SetBackendHandler(backupServer2, func(w http.ResponseWriter, r *http.Request) {
+		name := backupServer2.Name
+		t.Errorf("Server %s received a request and it shouldn't have", name)
+		w.Write([]byte(name))
+	})
+
+	SetBackendHandler(originServer, WithNoFallbackHeader(noFallbackHeader, "1", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(originServer.Name))
+	}))
+
+	req := NewUniqueEdgeGET(t)
+	resp := RoundTripCheckErrorInstrumented(t, req)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf(
+			"Expected edge to pass through origin's 503 rather than fall back to a mirror, got %d",
+			resp.StatusCode,
+		)
+	}
+
+	// A subsequent healthy response from origin should be served normally -
+	// the No-Fallback header must not stick around and blackhole the route.
+	const expectedBody = "back to normal"
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(expectedBody))
+	})
+
+	resp = RoundTripCheckErrorInstrumented(t, req)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected edge to recover once origin is healthy again, got %d", resp.StatusCode)
+	}
+	if bodyStr := bodyString(t, resp); bodyStr != expectedBody {
+		t.Errorf("Expected recovered body %q, got %q", expectedBody, bodyStr)
+	}
+}
+
+// Should flip to unhealthy within a bounded number of probe intervals once
+// origin starts failing its health check, and recover once it starts
+// responding correctly again. This uses the active HealthChecker directly,
+// rather than sleeping for an arbitrary period, so the failover tests above
+// don't need to guess how long a backend's health takes to flip.
+func TestFailoverOrigin5xxProbeDrivenDetection(t *testing.T) {
+	defer RecordTestLatency(t.Name(), time.Now())
+
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	hc := NewHealthChecker(
+		"/", http.StatusOK, nil,
+		failoverProbeInterval, failoverProbeTimeout,
+		failoverUnhealthyThreshold, failoverHealthyThreshold,
+	)
+	hc.Start([]*CDNBackendServer{originServer})
+	defer hc.Stop()
+
+	if err := hc.WaitUntilUnhealthy(originServer.Name, failoverWaitForFlip); err != nil {
+		t.Fatalf("Expected health checker to mark origin unhealthy: %s", err)
+	}
+
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(originServer.Name))
+	})
+
+	if err := hc.WaitUntilHealthy(originServer.Name, failoverWaitForFlip); err != nil {
+		t.Fatalf("Expected health checker to mark origin healthy again: %s", err)
+	}
 }
@@ -22,7 +22,7 @@ func TestRespHeaderAge(t *testing.T) {
 	const expectedAgeInSeconds = originAgeInSeconds + secondsToWaitBetweenRequests
 	requestReceivedCount := 0
 
-	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
 		if requestReceivedCount == 0 {
 			w.Header().Set("Cache-Control", "max-age=1800, public")
 			w.Header().Set("Age", fmt.Sprintf("%d", originAgeInSeconds))
@@ -34,7 +34,7 @@ func TestRespHeaderAge(t *testing.T) {
 	})
 
 	req := NewUniqueEdgeGET(t)
-	resp := RoundTripCheckError(t, req)
+	resp := RoundTripCheckErrorInstrumented(t, req)
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
@@ -43,7 +43,7 @@ func TestRespHeaderAge(t *testing.T) {
 
 	// wait a little bit. Edge should update the Age header, we know Origin will not
 	time.Sleep(time.Duration(secondsToWaitBetweenRequests) * time.Second)
-	resp = RoundTripCheckError(t, req)
+	resp = RoundTripCheckErrorInstrumented(t, req)
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
@@ -80,13 +80,13 @@ func TestRespHeaderXCacheAppend(t *testing.T) {
 		expectedXCache string
 	)
 
-	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("X-Cache", originXCache)
 	})
 
 	// Get first request, will come from origin, cannot be cached - hence cache MISS
 	req := NewUniqueEdgeGET(t)
-	resp := RoundTripCheckError(t, req)
+	resp := RoundTripCheckErrorInstrumented(t, req)
 	defer resp.Body.Close()
 
 	xCache = resp.Header.Get("X-Cache")
@@ -113,7 +113,7 @@ func TestRespHeaderXCacheCreate(t *testing.T) {
 
 	// Get first request, will come from origin, cannot be cached - hence cache MISS
 	req := NewUniqueEdgeGET(t)
-	resp := RoundTripCheckError(t, req)
+	resp := RoundTripCheckErrorInstrumented(t, req)
 	defer resp.Body.Close()
 
 	xCache = resp.Header.Get("X-Cache")
@@ -146,7 +146,7 @@ func TestRespHeaderServedBy(t *testing.T) {
 	}
 
 	req := NewUniqueEdgeGET(t)
-	resp := RoundTripCheckError(t, req)
+	resp := RoundTripCheckErrorInstrumented(t, req)
 	defer resp.Body.Close()
 
 	actualHeader := resp.Header.Get(headerName)
@@ -176,7 +176,7 @@ func TestRespHeaderXCacheHitsAppend(t *testing.T) {
 
 	uuid := NewUUID()
 
-	originServer.SwitchHandler(func(w http.ResponseWriter, r *http.Request) {
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "GET" && r.URL.Path == fmt.Sprintf("/%s", uuid) {
 			w.Header().Set("X-Cache-Hits", originXCacheHits)
 		}
@@ -186,7 +186,7 @@ func TestRespHeaderXCacheHitsAppend(t *testing.T) {
 
 	// Get first request, will come from origin. Edge Hit Count 0
 	req, _ := http.NewRequest("GET", sourceUrl, nil)
-	resp := RoundTripCheckError(t, req)
+	resp := RoundTripCheckErrorInstrumented(t, req)
 	defer resp.Body.Close()
 
 	xCacheHits = resp.Header.Get("X-Cache-Hits")
@@ -200,7 +200,7 @@ func TestRespHeaderXCacheHitsAppend(t *testing.T) {
 	}
 
 	// Get request again. Should come from Edge now, hit count 1
-	resp = RoundTripCheckError(t, req)
+	resp = RoundTripCheckErrorInstrumented(t, req)
 	defer resp.Body.Close()
 
 	xCacheHits = resp.Header.Get("X-Cache-Hits")
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// HealthChecker periodically probes a set of CDNBackendServers and
+// maintains an atomic view of whether each is currently considered healthy.
+// It exists so failover tests can wait for a backend's probed health to
+// flip, rather than sleeping for an arbitrary period. Probes go straight to
+// each backend's URL from the test process; the edge's own view of the
+// backend is not observed.
+type HealthChecker struct {
+	// Path is requested against each backend on every probe tick.
+	Path string
+	// ExpectedStatus is the HTTP status code a healthy backend must return.
+	ExpectedStatus int
+	// ExpectedBodyRegexp, if non-nil, must match a healthy backend's body.
+	ExpectedBodyRegexp *regexp.Regexp
+	// Interval is the time between probes of each backend.
+	Interval time.Duration
+	// Timeout bounds how long a single probe may take.
+	Timeout time.Duration
+	// UnhealthyThreshold is the number of consecutive failed probes
+	// required to mark a healthy backend as unhealthy.
+	UnhealthyThreshold int
+	// HealthyThreshold is the number of consecutive successful probes
+	// required to mark an unhealthy backend as healthy again.
+	HealthyThreshold int
+
+	client *http.Client
+
+	mu       sync.Mutex
+	states   map[string]*backendHealthState
+	stopOnce sync.Once
+	stopCh   chan struct{}
+}
+
+// backendHealthState guards its fields with mu so that a probe's flip from
+// healthy to unhealthy (or back) and a waiter's check-then-subscribe happen
+// atomically with respect to each other - otherwise a flip landing between
+// a waiter's state check and its subscription would be missed, and the
+// waiter would block needlessly until its timeout.
+type backendHealthState struct {
+	mu              sync.Mutex
+	healthy         bool
+	consecutiveGood int
+	consecutiveBad  int
+	healthySubs     []chan struct{}
+	unhealthySubs   []chan struct{}
+}
+
+// NewHealthChecker constructs a HealthChecker ready to probe the backends
+// passed to Start. All probed backends start in the healthy state until
+// proven otherwise.
+func NewHealthChecker(path string, expectedStatus int, expectedBodyRegexp *regexp.Regexp, interval, timeout time.Duration, unhealthyThreshold, healthyThreshold int) *HealthChecker {
+	return &HealthChecker{
+		Path:               path,
+		ExpectedStatus:     expectedStatus,
+		ExpectedBodyRegexp: expectedBodyRegexp,
+		Interval:           interval,
+		Timeout:            timeout,
+		UnhealthyThreshold: unhealthyThreshold,
+		HealthyThreshold:   healthyThreshold,
+		client:             &http.Client{Timeout: timeout},
+		states:             make(map[string]*backendHealthState),
+		stopCh:             make(chan struct{}),
+	}
+}
+
+// Start begins probing the given backends on a ticker, one goroutine per
+// backend, until Stop is called.
+func (hc *HealthChecker) Start(backends []*CDNBackendServer) {
+	for _, backend := range backends {
+		hc.mu.Lock()
+		state := &backendHealthState{healthy: true}
+		hc.states[backend.Name] = state
+		hc.mu.Unlock()
+
+		go hc.probeLoop(backend, state)
+	}
+}
+
+// Stop halts all probing goroutines started by Start.
+func (hc *HealthChecker) Stop() {
+	hc.stopOnce.Do(func() {
+		close(hc.stopCh)
+	})
+}
+
+func (hc *HealthChecker) probeLoop(backend *CDNBackendServer, state *backendHealthState) {
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hc.stopCh:
+			return
+		case <-ticker.C:
+			hc.probeOnce(backend, state)
+		}
+	}
+}
+
+func (hc *HealthChecker) probeOnce(backend *CDNBackendServer, state *backendHealthState) {
+	ok := hc.probe(backend)
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	if ok {
+		state.consecutiveGood++
+		state.consecutiveBad = 0
+		if !state.healthy && state.consecutiveGood >= hc.HealthyThreshold {
+			state.healthy = true
+			state.notifyLocked(true)
+		}
+	} else {
+		state.consecutiveBad++
+		state.consecutiveGood = 0
+		if state.healthy && state.consecutiveBad >= hc.UnhealthyThreshold {
+			state.healthy = false
+			state.notifyLocked(false)
+		}
+	}
+}
+
+func (hc *HealthChecker) probe(backend *CDNBackendServer) bool {
+	url := fmt.Sprintf("%s%s", backend.URL, hc.Path)
+	resp, err := hc.client.Get(url)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != hc.ExpectedStatus {
+		return false
+	}
+
+	if hc.ExpectedBodyRegexp == nil {
+		return true
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false
+	}
+
+	return hc.ExpectedBodyRegexp.Match(body)
+}
+
+// notifyLocked wakes any waiters subscribed to the given health state.
+// Callers must hold state.mu.
+func (state *backendHealthState) notifyLocked(healthy bool) {
+	var subs []chan struct{}
+	if healthy {
+		subs, state.healthySubs = state.healthySubs, nil
+	} else {
+		subs, state.unhealthySubs = state.unhealthySubs, nil
+	}
+	for _, sub := range subs {
+		close(sub)
+	}
+}
+
+// IsHealthy returns the last-known health state of the named backend.
+func (hc *HealthChecker) IsHealthy(name string) bool {
+	hc.mu.Lock()
+	state, ok := hc.states[name]
+	hc.mu.Unlock()
+	if !ok {
+		return false
+	}
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	return state.healthy
+}
+
+// WaitUntilHealthy blocks until the named backend is observed healthy, or
+// returns an error if d elapses first.
+func (hc *HealthChecker) WaitUntilHealthy(name string, d time.Duration) error {
+	return hc.waitUntil(name, true, d)
+}
+
+// WaitUntilUnhealthy blocks until the named backend is observed unhealthy,
+// or returns an error if d elapses first.
+func (hc *HealthChecker) WaitUntilUnhealthy(name string, d time.Duration) error {
+	return hc.waitUntil(name, false, d)
+}
+
+func (hc *HealthChecker) waitUntil(name string, healthy bool, d time.Duration) error {
+	hc.mu.Lock()
+	state, ok := hc.states[name]
+	hc.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("health checker: unknown backend %q", name)
+	}
+
+	state.mu.Lock()
+	if state.healthy == healthy {
+		state.mu.Unlock()
+		return nil
+	}
+
+	sub := make(chan struct{})
+	if healthy {
+		state.healthySubs = append(state.healthySubs, sub)
+	} else {
+		state.unhealthySubs = append(state.unhealthySubs, sub)
+	}
+	state.mu.Unlock()
+
+	select {
+	case <-sub:
+		return nil
+	case <-time.After(d):
+		return fmt.Errorf(
+			"health checker: timed out after %s waiting for %q to become healthy=%t",
+			d, name, healthy,
+		)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// Tests in this file cover the edge's cacheability policy for methods
+// beyond plain GET: HEAD should be served from a GET-populated cache
+// entry without contacting origin, POST responses may be cached per RFC
+// 7234 s4.4 when explicitly marked cacheable, and unsafe methods must
+// invalidate any cached representation of the URIs they touch.
+
+// Should serve HEAD from a cache entry populated by a prior GET, without
+// contacting origin again.
+func TestMethodCacheabilityHeadServedFromGetCache(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const expectedBody = "headed for the cache"
+	requestCount := 0
+
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		if r.Method == "HEAD" {
+			t.Error("Origin received a HEAD request for a URL already cached by a prior GET")
+		}
+		w.Header().Set("Cache-Control", "max-age=3600, public")
+		w.Write([]byte(expectedBody))
+	})
+
+	getReq := NewUniqueEdgeGET(t)
+	RoundTripCheckErrorInstrumented(t, getReq).Body.Close()
+
+	headReq, err := http.NewRequest("HEAD", getReq.URL.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := RoundTripCheckErrorInstrumented(t, headReq)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 for cached HEAD, got %d", resp.StatusCode)
+	}
+	if requestCount != 1 {
+		t.Errorf("Expected origin to see exactly 1 request (the GET), saw %d", requestCount)
+	}
+}
+
+// RFC 7234 s4.4 permits caching a POST response explicitly marked
+// cacheable with Cache-Control and Content-Location, served on subsequent
+// GETs to that location - but neither vendor this suite runs against does
+// so without non-default configuration, so there is no vendor under which
+// to exercise that behaviour here. Fastly requires custom VCL and
+// Cloudflare does not cache POST responses by default; both skip.
+func TestMethodCacheabilityPostWithContentLocationCached(t *testing.T) {
+	switch {
+	case vendorFastly:
+		t.Skip("Fastly requires custom VCL to cache POST responses")
+	case vendorCloudflare:
+		t.Skip("Cloudflare does not cache POST responses by default")
+	default:
+		t.Fatal(notImplementedForVendor)
+	}
+}
+
+// Should invalidate any cached representation of the request-URI when an
+// unsafe method is used against it, so a follow-up GET hits origin again.
+func TestMethodCacheabilityUnsafeMethodInvalidatesRequestURI(t *testing.T) {
+	methods := []string{"POST", "PUT", "PATCH", "DELETE"}
+
+	for _, method := range methods {
+		ResetBackends(backendsByPriority)
+
+		const cachedBody = "before the unsafe method"
+		requestCount := 0
+
+		SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+			requestCount++
+			switch r.Method {
+			case "GET":
+				w.Header().Set("Cache-Control", "public, max-age=3600")
+				w.Write([]byte(cachedBody))
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+		})
+
+		getReq := NewUniqueEdgeGET(t)
+		RoundTripCheckErrorInstrumented(t, getReq).Body.Close()
+
+		unsafeReq, err := http.NewRequest(method, getReq.URL.String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		RoundTripCheckErrorInstrumented(t, unsafeReq).Body.Close()
+
+		RoundTripCheckErrorInstrumented(t, getReq).Body.Close()
+
+		if requestCount != 3 {
+			t.Errorf(
+				"Method %s: expected origin to see 3 requests (GET, %s, GET), saw %d",
+				method, method, requestCount,
+			)
+		}
+	}
+}
+
+// Should invalidate the cached representation at a response's
+// Content-Location target, not just the request-URI, when an unsafe
+// method succeeds against it.
+func TestMethodCacheabilityUnsafeMethodInvalidatesContentLocationTarget(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	uuid := NewUUID()
+	targetPath := fmt.Sprintf("/%s", uuid)
+	targetUrl := fmt.Sprintf("https://%s%s", *edgeHost, targetPath)
+
+	const cachedBody = "the old resource"
+	targetRequestCount := 0
+
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == targetPath && r.Method == "GET":
+			targetRequestCount++
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			w.Write([]byte(cachedBody))
+		case r.Method == "DELETE":
+			w.Header().Set("Content-Location", targetPath)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	targetReq, err := http.NewRequest("GET", targetUrl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RoundTripCheckErrorInstrumented(t, targetReq).Body.Close()
+
+	deleteReq := NewUniqueEdgeGET(t)
+	deleteReq.Method = "DELETE"
+	RoundTripCheckErrorInstrumented(t, deleteReq).Body.Close()
+
+	RoundTripCheckErrorInstrumented(t, targetReq).Body.Close()
+
+	if targetRequestCount != 2 {
+		t.Errorf(
+			"Expected Content-Location target to be invalidated and re-fetched from origin, saw %d requests",
+			targetRequestCount,
+		)
+	}
+}
+
+// Should invalidate the cached representation at a response's Location
+// target, not just the request-URI, when an unsafe method succeeds
+// against it.
+func TestMethodCacheabilityUnsafeMethodInvalidatesLocationTarget(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	uuid := NewUUID()
+	targetPath := fmt.Sprintf("/%s", uuid)
+	targetUrl := fmt.Sprintf("https://%s%s", *edgeHost, targetPath)
+
+	const cachedBody = "the old resource"
+	targetRequestCount := 0
+
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == targetPath && r.Method == "GET":
+			targetRequestCount++
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			w.Write([]byte(cachedBody))
+		case r.Method == "PUT":
+			w.Header().Set("Location", targetPath)
+			w.WriteHeader(http.StatusCreated)
+		}
+	})
+
+	targetReq, err := http.NewRequest("GET", targetUrl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RoundTripCheckErrorInstrumented(t, targetReq).Body.Close()
+
+	putReq := NewUniqueEdgeGET(t)
+	putReq.Method = "PUT"
+	RoundTripCheckErrorInstrumented(t, putReq).Body.Close()
+
+	RoundTripCheckErrorInstrumented(t, targetReq).Body.Close()
+
+	if targetRequestCount != 2 {
+		t.Errorf(
+			"Expected Location target to be invalidated and re-fetched from origin, saw %d requests",
+			targetRequestCount,
+		)
+	}
+}
+
+// Should treat OPTIONS as uncacheable and always pass it through to
+// origin, regardless of a prior GET to the same URL.
+func TestMethodCacheabilityOptionsPassesThrough(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	optionsRequestCount := 0
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" {
+			optionsRequestCount++
+			w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Write([]byte("cacheable GET body"))
+	})
+
+	getReq := NewUniqueEdgeGET(t)
+	RoundTripCheckErrorInstrumented(t, getReq).Body.Close()
+
+	optionsReq, err := http.NewRequest("OPTIONS", getReq.URL.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RoundTripCheckErrorInstrumented(t, optionsReq).Body.Close()
+	RoundTripCheckErrorInstrumented(t, optionsReq).Body.Close()
+
+	if optionsRequestCount != 2 {
+		t.Errorf("Expected both OPTIONS requests to reach origin uncached, saw %d", optionsRequestCount)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Metrics is a small, dependency-free Prometheus-style registry for the
+// test harness itself. It lets operators running this suite against
+// Fastly/Cloudflare/Akamai get a machine-readable view of behavioural drift
+// over time: requests per backend, cache HIT/MISS ratios, revalidation
+// counts, and failover events, alongside per-test latency.
+type Metrics struct {
+	mu sync.Mutex
+
+	backendRequests map[string]int64
+	cacheResults    map[string]int64 // keyed by the full X-Cache value, e.g. "HIT, MISS"
+	statusCodes     map[int]int64
+	revalidations   int64
+	failoverEvents  map[string]int64
+	testLatencies   map[string]time.Duration
+}
+
+// metricsRegistry is the process-wide instance instrumented by the harness.
+// Tests and helpers call the package-level Record* functions below rather
+// than reaching into this directly.
+var metricsRegistry = NewMetrics()
+
+// NewMetrics returns an empty, ready-to-use Metrics registry.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		backendRequests: make(map[string]int64),
+		cacheResults:    make(map[string]int64),
+		statusCodes:     make(map[int]int64),
+		failoverEvents:  make(map[string]int64),
+		testLatencies:   make(map[string]time.Duration),
+	}
+}
+
+// RecordBackendRequest increments the request counter for the named
+// backend. Called via InstrumentBackendHandler/SetBackendHandler below, so
+// every request served by a handler installed with SetBackendHandler is
+// tallied; requests served by a handler installed by calling SwitchHandler
+// directly are not counted.
+func RecordBackendRequest(backendName string) {
+	metricsRegistry.mu.Lock()
+	defer metricsRegistry.mu.Unlock()
+	metricsRegistry.backendRequests[backendName]++
+}
+
+// InstrumentBackendHandler wraps a backend handler so that every request it
+// serves increments that backend's counter before the handler runs.
+func InstrumentBackendHandler(backendName string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		RecordBackendRequest(backendName)
+		handler(w, r)
+	}
+}
+
+// SetBackendHandler installs handler on server via SwitchHandler, wrapped
+// with InstrumentBackendHandler so the per-backend request counter stays
+// accurate. Tests should call this instead of server.SwitchHandler directly
+// wherever the resulting counters matter.
+func SetBackendHandler(server *CDNBackendServer, handler http.HandlerFunc) {
+	server.SwitchHandler(InstrumentBackendHandler(server.Name, handler))
+}
+
+// RecordResponse tallies the X-Cache value and status code of a response
+// received at the edge. Called via RoundTripCheckErrorInstrumented, so every
+// round trip made through it is tallied; round trips made through
+// RoundTripCheckError or client.RoundTrip directly are counted only where
+// the caller invokes RecordResponse itself.
+func RecordResponse(xCache string, statusCode int) {
+	metricsRegistry.mu.Lock()
+	defer metricsRegistry.mu.Unlock()
+	if xCache != "" {
+		metricsRegistry.cacheResults[xCache]++
+	}
+	metricsRegistry.statusCodes[statusCode]++
+}
+
+// RecordRevalidation increments the count of conditional revalidation round
+// trips observed by the suite.
+func RecordRevalidation() {
+	metricsRegistry.mu.Lock()
+	defer metricsRegistry.mu.Unlock()
+	metricsRegistry.revalidations++
+}
+
+// RecordFailoverEvent increments the count of times the edge was observed
+// to fail over to the named backend.
+func RecordFailoverEvent(backendName string) {
+	metricsRegistry.mu.Lock()
+	defer metricsRegistry.mu.Unlock()
+	metricsRegistry.failoverEvents[backendName]++
+}
+
+// RecordTestLatency records the wall-clock duration of a single test, keyed
+// by test name. Intended to be called from a deferred func at the top of
+// each test, e.g. `defer RecordTestLatency(t.Name(), time.Now())`.
+func RecordTestLatency(testName string, start time.Time) {
+	metricsRegistry.mu.Lock()
+	defer metricsRegistry.mu.Unlock()
+	metricsRegistry.testLatencies[testName] = time.Since(start)
+}
+
+// ServeHTTP renders the registry in Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP cdn_acceptance_backend_requests_total Requests received per backend.")
+	fmt.Fprintln(w, "# TYPE cdn_acceptance_backend_requests_total counter")
+	for _, name := range sortedKeys(m.backendRequests) {
+		fmt.Fprintf(w, "cdn_acceptance_backend_requests_total{backend=%q} %d\n", name, m.backendRequests[name])
+	}
+
+	fmt.Fprintln(w, "# HELP cdn_acceptance_cache_result_total Edge responses observed, keyed by X-Cache value.")
+	fmt.Fprintln(w, "# TYPE cdn_acceptance_cache_result_total counter")
+	for _, result := range sortedKeys(m.cacheResults) {
+		fmt.Fprintf(w, "cdn_acceptance_cache_result_total{result=%q} %d\n", result, m.cacheResults[result])
+	}
+
+	fmt.Fprintln(w, "# HELP cdn_acceptance_status_code_total Edge responses observed, keyed by HTTP status code.")
+	fmt.Fprintln(w, "# TYPE cdn_acceptance_status_code_total counter")
+	for _, status := range sortedIntKeys(m.statusCodes) {
+		fmt.Fprintf(w, "cdn_acceptance_status_code_total{status=\"%d\"} %d\n", status, m.statusCodes[status])
+	}
+
+	fmt.Fprintln(w, "# HELP cdn_acceptance_revalidations_total Conditional revalidation round trips observed.")
+	fmt.Fprintln(w, "# TYPE cdn_acceptance_revalidations_total counter")
+	fmt.Fprintf(w, "cdn_acceptance_revalidations_total %d\n", m.revalidations)
+
+	fmt.Fprintln(w, "# HELP cdn_acceptance_failover_events_total Failovers to a backend observed.")
+	fmt.Fprintln(w, "# TYPE cdn_acceptance_failover_events_total counter")
+	for _, name := range sortedKeys(m.failoverEvents) {
+		fmt.Fprintf(w, "cdn_acceptance_failover_events_total{backend=%q} %d\n", name, m.failoverEvents[name])
+	}
+
+	fmt.Fprintln(w, "# HELP cdn_acceptance_test_duration_seconds Wall-clock duration of each test.")
+	fmt.Fprintln(w, "# TYPE cdn_acceptance_test_duration_seconds gauge")
+	for _, name := range sortedDurationKeys(m.testLatencies) {
+		fmt.Fprintf(w, "cdn_acceptance_test_duration_seconds{test=%q} %f\n", name, m.testLatencies[name].Seconds())
+	}
+}
+
+// ServeMetrics starts a local HTTP server exposing the registry at /metrics
+// in Prometheus text format. It returns immediately; the server runs until
+// the process exits. Called once from TestMain, before m.Run(), so it's
+// live for the duration of the suite.
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsRegistry)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go http.Serve(listener, mux)
+	return nil
+}
+
+// testSummary is the shape written to the end-of-run JSON summary file.
+type testSummary struct {
+	BackendRequests map[string]int64   `json:"backend_requests"`
+	CacheResults    map[string]int64   `json:"cache_results"`
+	StatusCodes     map[string]int64   `json:"status_codes"`
+	Revalidations   int64              `json:"revalidations"`
+	FailoverEvents  map[string]int64   `json:"failover_events"`
+	TestLatencies   map[string]float64 `json:"test_latencies_seconds"`
+}
+
+// WriteJSONSummary writes a structured snapshot of the registry to path.
+// Called once from TestMain, after m.Run() and before calling os.Exit with
+// its result, so the summary reflects the whole run.
+func WriteJSONSummary(path string) error {
+	metricsRegistry.mu.Lock()
+	summary := testSummary{
+		BackendRequests: copyInt64Map(metricsRegistry.backendRequests),
+		CacheResults:    copyInt64Map(metricsRegistry.cacheResults),
+		StatusCodes:     make(map[string]int64, len(metricsRegistry.statusCodes)),
+		Revalidations:   metricsRegistry.revalidations,
+		FailoverEvents:  copyInt64Map(metricsRegistry.failoverEvents),
+		TestLatencies:   make(map[string]float64, len(metricsRegistry.testLatencies)),
+	}
+	for status, count := range metricsRegistry.statusCodes {
+		summary.StatusCodes[fmt.Sprintf("%d", status)] = count
+	}
+	for name, d := range metricsRegistry.testLatencies {
+		summary.TestLatencies[name] = d.Seconds()
+	}
+	metricsRegistry.mu.Unlock()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return writeJSON(f, summary)
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func copyInt64Map(src map[string]int64) map[string]int64 {
+	dst := make(map[string]int64, len(src))
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedIntKeys(m map[int]int64) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func sortedDurationKeys(m map[string]time.Duration) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
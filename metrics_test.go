@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+var (
+	metricsAddr        = flag.String("metrics.addr", ":9090", "address to expose the Prometheus-style /metrics endpoint on for the duration of the suite")
+	metricsSummaryPath = flag.String("metrics.summary", "test_output.txt", "path to write the end-of-run JSON metrics summary to")
+)
+
+// TestMain starts the metrics server before the suite runs and writes the
+// JSON summary once it's done, so both are covered for every invocation of
+// `go test` rather than requiring each test to wire them up itself.
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	if err := ServeMetrics(*metricsAddr); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start metrics server: %v\n", err)
+		os.Exit(1)
+	}
+
+	result := m.Run()
+
+	if err := WriteJSONSummary(*metricsSummaryPath); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write metrics summary: %v\n", err)
+		os.Exit(1)
+	}
+
+	os.Exit(result)
+}
+
+// RoundTripCheckErrorInstrumented wraps RoundTripCheckError so every round
+// trip made through it is tallied by X-Cache value and status code. Tests
+// should call this instead of RoundTripCheckError directly wherever the
+// resulting metrics matter.
+func RoundTripCheckErrorInstrumented(t *testing.T, req *http.Request) *http.Response {
+	resp := RoundTripCheckError(t, req)
+	RecordResponse(resp.Header.Get("X-Cache"), resp.StatusCode)
+	return resp
+}
+
+// Should render recorded counters in Prometheus text exposition format.
+func TestMetricsServeHTTPRendersPrometheusFormat(t *testing.T) {
+	m := NewMetrics()
+	m.backendRequests["origin"] = 3
+	m.cacheResults["HIT, MISS"] = 1
+	m.statusCodes[200] = 2
+	m.revalidations = 1
+	m.failoverEvents["backupServer1"] = 1
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, req)
+
+	body, err := ioutil.ReadAll(rec.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := string(body)
+
+	for _, want := range []string{
+		`cdn_acceptance_backend_requests_total{backend="origin"} 3`,
+		`cdn_acceptance_cache_result_total{result="HIT, MISS"} 1`,
+		`cdn_acceptance_status_code_total{status="200"} 2`,
+		`cdn_acceptance_revalidations_total 1`,
+		`cdn_acceptance_failover_events_total{backend="backupServer1"} 1`,
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected /metrics output to contain %q, got:\n%s", want, output)
+		}
+	}
+}
+
+// Should record backend requests, responses, and failover events against
+// the registry they were given.
+func TestMetricsRecordFunctions(t *testing.T) {
+	m := NewMetrics()
+	withMetricsRegistry(m, func() {
+		RecordBackendRequest("originServer")
+		RecordResponse("HIT", 200)
+		RecordRevalidation()
+		RecordFailoverEvent("backupServer1")
+	})
+
+	if m.backendRequests["originServer"] != 1 {
+		t.Errorf("Expected 1 recorded request for originServer, got %d", m.backendRequests["originServer"])
+	}
+	if m.cacheResults["HIT"] != 1 {
+		t.Errorf("Expected 1 recorded HIT cache result, got %d", m.cacheResults["HIT"])
+	}
+	if m.statusCodes[200] != 1 {
+		t.Errorf("Expected 1 recorded 200 status, got %d", m.statusCodes[200])
+	}
+	if m.revalidations != 1 {
+		t.Errorf("Expected 1 recorded revalidation, got %d", m.revalidations)
+	}
+	if m.failoverEvents["backupServer1"] != 1 {
+		t.Errorf("Expected 1 recorded failover event for backupServer1, got %d", m.failoverEvents["backupServer1"])
+	}
+}
+
+// withMetricsRegistry swaps the package-level registry for the duration of
+// fn, so tests can assert on Record* calls without polluting the shared
+// registry used by the rest of the suite.
+func withMetricsRegistry(m *Metrics, fn func()) {
+	previous := metricsRegistry
+	metricsRegistry = m
+	defer func() { metricsRegistry = previous }()
+	fn()
+}
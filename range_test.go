@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// Tests in this file cover Range/partial-content handling at the edge: an
+// origin response stored as a full 200 should be sliceable into 206s by the
+// edge, and validators on a Range request should follow the same freshness
+// rules as a full GET.
+
+const rangeTestBody = "the quick brown fox jumps over the lazy dog"
+
+func originHandlerRangeable(body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, public")
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Write([]byte(body))
+	}
+}
+
+// Should return a 206 Partial Content with the correct Content-Range and
+// sliced body when a single Range is requested against a cached object.
+func TestRangeSingleRangeReturnsPartialContent(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	SetBackendHandler(originServer, originHandlerRangeable(rangeTestBody))
+
+	const start, end = 4, 9
+	expectedBody := rangeTestBody[start : end+1]
+	expectedContentRange := fmt.Sprintf("bytes %d-%d/%d", start, end, len(rangeTestBody))
+
+	req := NewUniqueEdgeGET(t)
+	// Prime the cache with a full-body response before requesting a range.
+	RoundTripCheckErrorInstrumented(t, req).Body.Close()
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	resp := RoundTripCheckErrorInstrumented(t, req)
+
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("Expected 206 Partial Content, got %d", resp.StatusCode)
+	}
+	if cr := resp.Header.Get("Content-Range"); cr != expectedContentRange {
+		t.Errorf("Unexpected Content-Range: got %q, want %q", cr, expectedContentRange)
+	}
+	if bodyStr := bodyString(t, resp); bodyStr != expectedBody {
+		t.Errorf("Unexpected sliced body: got %q, want %q", bodyStr, expectedBody)
+	}
+}
+
+// Should return either a multipart/byteranges response or a well-formed
+// full 200 when multiple ranges are requested in a single request.
+func TestRangeMultiRangeRequest(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	SetBackendHandler(originServer, originHandlerRangeable(rangeTestBody))
+
+	req := NewUniqueEdgeGET(t)
+	RoundTripCheckErrorInstrumented(t, req).Body.Close()
+
+	req.Header.Set("Range", "bytes=0-4,10-14")
+	resp := RoundTripCheckErrorInstrumented(t, req)
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		ct := resp.Header.Get("Content-Type")
+		if len(ct) < len("multipart/byteranges") || ct[:len("multipart/byteranges")] != "multipart/byteranges" {
+			t.Errorf("Expected multipart/byteranges Content-Type for 206 multi-range, got %q", ct)
+		}
+	case http.StatusOK:
+		if bodyStr := bodyString(t, resp); bodyStr != rangeTestBody {
+			t.Errorf("Expected full body on 200 fallback, got %q", bodyStr)
+		}
+	default:
+		t.Errorf("Unexpected status for multi-range request: %d", resp.StatusCode)
+	}
+}
+
+// Should honour If-Range: a matching validator yields a 206, a stale
+// validator yields the full 200.
+func TestRangeIfRangeValidator(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	const etag = `"range-etag"`
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600, public")
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(rangeTestBody))
+	})
+
+	req := NewUniqueEdgeGET(t)
+	primeResp := RoundTripCheckErrorInstrumented(t, req)
+	primeResp.Body.Close()
+
+	req.Header.Set("Range", "bytes=0-4")
+	req.Header.Set("If-Range", etag)
+	resp := RoundTripCheckErrorInstrumented(t, req)
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Errorf("Expected 206 for matching If-Range validator, got %d", resp.StatusCode)
+	}
+
+	req.Header.Set("If-Range", `"stale-etag"`)
+	resp = RoundTripCheckErrorInstrumented(t, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected full 200 for stale If-Range validator, got %d", resp.StatusCode)
+	}
+	if bodyStr := bodyString(t, resp); bodyStr != rangeTestBody {
+		t.Errorf("Expected full body for stale If-Range validator, got %q", bodyStr)
+	}
+}
+
+// Should not store a 206 response received directly from origin. Storing a
+// full 200 and slicing it at the edge is checked by
+// TestRangeSingleRangeReturnsPartialContent.
+func TestRangeOriginPartialResponseNotCached(t *testing.T) {
+	ResetBackends(backendsByPriority)
+
+	requestCount := 0
+	SetBackendHandler(originServer, func(w http.ResponseWriter, r *http.Request) {
+		requestCount++
+		w.Header().Set("Cache-Control", "max-age=3600, public")
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes 0-4/%d", len(rangeTestBody)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(rangeTestBody[0:5]))
+	})
+
+	req := NewUniqueEdgeGET(t)
+	req.Header.Set("Range", "bytes=0-4")
+	RoundTripCheckErrorInstrumented(t, req).Body.Close()
+	RoundTripCheckErrorInstrumented(t, req).Body.Close()
+
+	if requestCount < 2 {
+		t.Error("Expected origin's uncacheable 206 response not to be stored at the edge")
+	}
+}